@@ -1,19 +1,71 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"go/ast"
 	"go/format"
+	"go/parser"
 	"go/token"
 	"go/types"
 	"log"
 	"os"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/tools/go/packages"
 )
 
+var manifestPath = flag.String("manifest", "", "write a JSON resource-mapping manifest to this path")
+var stripFlag = flag.String("strip", "create,update,delete", "comma-separated set of bodies to strip: create,update,delete,read,schema,attributes,customizediff,timeouts")
+var pruneFlag = flag.Bool("prune", false, "prune unused imports and helpers unreachable from a package's Registration entrypoints (destructive; does not affect the generated slim files)")
+var jFlag = flag.Int("j", 0, "maximum number of service packages to rewrite concurrently (default: GOMAXPROCS)")
+
+// parallelism returns the worker cap for the per-package rewrite passes: the
+// -j flag if set, otherwise GOMAXPROCS.
+func parallelism() int {
+	if *jFlag > 0 {
+		return *jFlag
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// stripSet is the parsed form of -strip: the set of things this run should
+// blank out.
+type stripSet map[string]bool
+
+func parseStripFlag(s string) stripSet {
+	set := stripSet{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		set[part] = true
+	}
+	return set
+}
+
+// resourceMapping is one entry in the manifest produced by buildManifest: it
+// records which Go factory backs a given Terraform resource or data source
+// type name. File and Line give where that factory expression appears in the
+// Registration method; the factory's own declaration site is not recorded.
+type resourceMapping struct {
+	Package string `json:"package"`
+	Name    string `json:"name"`
+	Kind    string `json:"kind"` // "resource" or "data_source"
+	GoType  string `json:"go_type"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+}
+
 func run() error {
 	dir := "."
 	cfg := packages.Config{Dir: dir, Mode: packages.LoadSyntax}
@@ -44,111 +96,410 @@ func run() error {
 		}
 	}
 
-	if err := forUntyped(pluginsdkPkg, servicePkgs); err != nil {
+	strip := parseStripFlag(*stripFlag)
+
+	collector := newStubCollector()
+
+	if err := forUntyped(pluginsdkPkg, servicePkgs, strip, collector); err != nil {
+		return err
+	}
+
+	if err := forTyped(sdkPkg, servicePkgs, strip, collector); err != nil {
 		return err
 	}
 
-	if err := forTyped(sdkPkg, servicePkgs); err != nil {
+	if err := writeDualMode(collector); err != nil {
 		return err
 	}
 
+	if *pruneFlag {
+		if err := prune(sdkPkg, servicePkgs, collector); err != nil {
+			return fmt.Errorf("pruning: %w", err)
+		}
+		verifyCfg := packages.Config{Dir: dir, Mode: packages.LoadSyntax}
+		verifyPkgs, err := packages.Load(&verifyCfg, "./internal/...")
+		if err != nil {
+			return err
+		}
+		if packages.PrintErrors(verifyPkgs) > 0 {
+			return errors.New("pruned tree no longer compiles")
+		}
+	}
+
+	if *manifestPath != "" {
+		mapping, err := buildManifest(sdkPkg, servicePkgs)
+		if err != nil {
+			return fmt.Errorf("building manifest: %w", err)
+		}
+		if err := writeManifest(*manifestPath, mapping); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func forUntyped(pluginsdkPkg *packages.Package, servicePkgs []*packages.Package) error {
-	var crudFuncType types.Type
+// untypedKeyToStrip maps a pluginsdk.Resource struct field name to the
+// -strip flag value that gates blanking it out.
+var untypedKeyToStrip = map[string]string{
+	"Create":        "create",
+	"Update":        "update",
+	"Delete":        "delete",
+	"Read":          "read",
+	"Schema":        "schema",
+	"SchemaFunc":    "schema",
+	"CustomizeDiff": "customizediff",
+}
+
+// schemaCalleeIdent reports the identifier a Schema/SchemaFunc field value
+// refers to when it isn't an inline composite literal/func literal: either a
+// bare function value (`SchemaFunc: resourceFooSchema`) or a call to one
+// (`Schema: resourceFooSchema()`), both common ways to factor a schema
+// out of the factory itself.
+func schemaCalleeIdent(expr ast.Expr) (*ast.Ident, bool) {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return e, true
+	case *ast.CallExpr:
+		if ident, ok := e.Fun.(*ast.Ident); ok {
+			return ident, true
+		}
+	}
+	return nil, false
+}
+
+// forUntyped locates every pluginsdk.Resource factory and, for the fields
+// selected by strip, registers a stand-in implementation with collector
+// instead of touching the original declarations: the factory itself when it
+// inlines its Schema/SchemaFunc/Timeouts, and separately the named
+// Create/Update/Delete/Read/CustomizeDiff/SchemaFunc functions it refers to.
+func forUntyped(pluginsdkPkg *packages.Package, servicePkgs []*packages.Package, strip stripSet, collector *stubCollector) error {
+	var crudFuncType, customizeDiffFuncType types.Type
 
 	for ident, obj := range pluginsdkPkg.TypesInfo.Defs {
-		if ident.Name == "CreateFunc" {
+		switch ident.Name {
+		case "CreateFunc":
 			crudFuncType = obj.(*types.TypeName).Type().(*types.Named).Underlying().(*types.Signature)
+		case "CustomizeDiffFunc":
+			customizeDiffFuncType = obj.(*types.TypeName).Type().(*types.Named).Underlying().(*types.Signature)
 		}
 	}
 
-	// Find all uses (i.e. ident -> types.Object) of the CUD functions in the schema declaration
-	cudObjs := map[types.Object]bool{}
+	// objStubs records, per referenced function object, the kind of stub
+	// body it needs ("nil" or "schema"). It's built by the first parallel
+	// scan below, one goroutine per service package, guarded by objStubsMu.
+	objStubs := map[types.Object]string{}
+	var objStubsMu sync.Mutex
+
+	scan := &errgroup.Group{}
+	scan.SetLimit(parallelism())
 	for _, pkg := range servicePkgs {
-		for _, file := range pkg.Syntax {
-			for _, decl := range file.Decls {
-				fdecl, ok := decl.(*ast.FuncDecl)
-				if !ok {
-					continue
-				}
-				if fdecl.Type == nil || fdecl.Type.Results == nil {
-					continue
-				}
-				if len(fdecl.Type.Results.List) != 1 {
-					continue
-				}
-				ret := fdecl.Type.Results.List[0]
-				sexpr, ok := ret.Type.(*ast.StarExpr)
-				if !ok {
-					continue
-				}
-				sel, ok := sexpr.X.(*ast.SelectorExpr)
-				if !ok {
-					continue
-				}
-				x, ok := sel.X.(*ast.Ident)
-				if !ok {
-					continue
-				}
-				if x.Name != "pluginsdk" {
-					continue
-				}
-				if sel.Sel.Name != "Resource" {
-					continue
-				}
-				ast.Inspect(fdecl.Body, func(n ast.Node) bool {
-					kvexpr, ok := n.(*ast.KeyValueExpr)
+		pkg := pkg
+		scan.Go(func() error {
+			for _, file := range pkg.Syntax {
+				for _, decl := range file.Decls {
+					fdecl, ok := decl.(*ast.FuncDecl)
 					if !ok {
-						return true
+						continue
+					}
+					if fdecl.Type == nil || fdecl.Type.Results == nil {
+						continue
+					}
+					if len(fdecl.Type.Results.List) != 1 {
+						continue
 					}
-					keyIdent, ok := kvexpr.Key.(*ast.Ident)
+					ret := fdecl.Type.Results.List[0]
+					sexpr, ok := ret.Type.(*ast.StarExpr)
 					if !ok {
-						return true
+						continue
 					}
-					if !(keyIdent.Name == "Create" || keyIdent.Name == "Update" || keyIdent.Name == "Delete") {
-						return true
+					sel, ok := sexpr.X.(*ast.SelectorExpr)
+					if !ok {
+						continue
+					}
+					x, ok := sel.X.(*ast.Ident)
+					if !ok {
+						continue
 					}
-					if !types.Identical(pkg.TypesInfo.TypeOf(kvexpr.Value), crudFuncType) {
-						return true
+					if x.Name != "pluginsdk" {
+						continue
 					}
-					cudObjs[pkg.TypesInfo.Uses[kvexpr.Value.(*ast.Ident)]] = true
-					return false
-				})
+					if sel.Sel.Name != "Resource" {
+						continue
+					}
+
+					var factoryNeedsStub bool
+					ast.Inspect(fdecl.Body, func(n ast.Node) bool {
+						kvexpr, ok := n.(*ast.KeyValueExpr)
+						if !ok {
+							return true
+						}
+						keyIdent, ok := kvexpr.Key.(*ast.Ident)
+						if !ok {
+							return true
+						}
+						stripName, known := untypedKeyToStrip[keyIdent.Name]
+						if !known || !strip[stripName] {
+							return true
+						}
+
+						switch keyIdent.Name {
+						case "Create", "Update", "Delete", "Read":
+							if !types.Identical(pkg.TypesInfo.TypeOf(kvexpr.Value), crudFuncType) {
+								return true
+							}
+							if ident, ok := kvexpr.Value.(*ast.Ident); ok {
+								objStubsMu.Lock()
+								objStubs[pkg.TypesInfo.Uses[ident]] = "nil"
+								objStubsMu.Unlock()
+							}
+						case "CustomizeDiff":
+							if !types.Identical(pkg.TypesInfo.TypeOf(kvexpr.Value), customizeDiffFuncType) {
+								return true
+							}
+							if ident, ok := kvexpr.Value.(*ast.Ident); ok {
+								objStubsMu.Lock()
+								objStubs[pkg.TypesInfo.Uses[ident]] = "nil"
+								objStubsMu.Unlock()
+							}
+						case "Schema":
+							if _, ok := kvexpr.Value.(*ast.CompositeLit); ok {
+								factoryNeedsStub = true
+							} else if ident, ok := schemaCalleeIdent(kvexpr.Value); ok {
+								objStubsMu.Lock()
+								objStubs[pkg.TypesInfo.Uses[ident]] = "schema"
+								objStubsMu.Unlock()
+							}
+						case "SchemaFunc":
+							if _, ok := kvexpr.Value.(*ast.FuncLit); ok {
+								factoryNeedsStub = true
+							} else if ident, ok := schemaCalleeIdent(kvexpr.Value); ok {
+								objStubsMu.Lock()
+								objStubs[pkg.TypesInfo.Uses[ident]] = "schema"
+								objStubsMu.Unlock()
+							}
+						}
+						return false
+					})
+
+					if strip["timeouts"] {
+						ast.Inspect(fdecl.Body, func(n ast.Node) bool {
+							clit, ok := n.(*ast.CompositeLit)
+							if !ok {
+								return true
+							}
+							for _, elt := range clit.Elts {
+								kv, ok := elt.(*ast.KeyValueExpr)
+								if !ok {
+									continue
+								}
+								if keyIdent, ok := kv.Key.(*ast.Ident); ok && keyIdent.Name == "Timeouts" {
+									factoryNeedsStub = true
+								}
+							}
+							return true
+						})
+					}
+
+					if factoryNeedsStub {
+						clone, err := collector.clone(pkg, file, fdecl, func(p *packages.Package, seen map[string]*types.PkgName) {
+							scanUntypedFactoryImports(p, fdecl, strip, seen)
+						})
+						if err != nil {
+							return err
+						}
+						applyUntypedFactoryStrip(clone, strip)
+					}
+				}
 			}
-		}
+			return nil
+		})
+	}
+	if err := scan.Wait(); err != nil {
+		return err
 	}
 
-	// Rewrite these CUD function's definitions
+	// Stub out the referenced Create/Update/Delete/Read/CustomizeDiff/Schema
+	// functions in a clone, leaving the originals untouched. This second
+	// stage runs only once objStubs is complete, one goroutine per package.
+	rewrite := &errgroup.Group{}
+	rewrite.SetLimit(parallelism())
 	for _, pkg := range servicePkgs {
-		for _, file := range pkg.Syntax {
-			var modified bool
-			for _, decl := range file.Decls {
-				fdecl, ok := decl.(*ast.FuncDecl)
-				if !ok {
-					continue
+		pkg := pkg
+		rewrite.Go(func() error {
+			for _, file := range pkg.Syntax {
+				for _, decl := range file.Decls {
+					fdecl, ok := decl.(*ast.FuncDecl)
+					if !ok {
+						continue
+					}
+					objStubsMu.Lock()
+					kind, ok := objStubs[pkg.TypesInfo.Defs[fdecl.Name]]
+					objStubsMu.Unlock()
+					if !ok {
+						continue
+					}
+					clone, err := collector.clone(pkg, file, fdecl, nil)
+					if err != nil {
+						return err
+					}
+					if kind == "schema" {
+						clone.Body.List = schemaReturnStmt()
+					} else {
+						clone.Body.List = nilReturnStmt()
+					}
 				}
-				if _, ok := cudObjs[pkg.TypesInfo.Defs[fdecl.Name]]; !ok {
+			}
+			return nil
+		})
+	}
+	return rewrite.Wait()
+}
+
+// applyUntypedFactoryStrip trims the Schema/SchemaFunc/Timeouts fields
+// inlined directly in a pluginsdk.Resource factory's composite literal. It
+// operates on a clone produced by stubCollector.clone, never the original.
+func applyUntypedFactoryStrip(fdecl *ast.FuncDecl, strip stripSet) {
+	ast.Inspect(fdecl.Body, func(n ast.Node) bool {
+		kvexpr, ok := n.(*ast.KeyValueExpr)
+		if !ok {
+			return true
+		}
+		keyIdent, ok := kvexpr.Key.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		switch keyIdent.Name {
+		case "Schema":
+			if !strip["schema"] {
+				return true
+			}
+			if mlit, ok := kvexpr.Value.(*ast.CompositeLit); ok {
+				mlit.Elts = nil
+			}
+		case "SchemaFunc":
+			if !strip["schema"] {
+				return true
+			}
+			if flit, ok := kvexpr.Value.(*ast.FuncLit); ok {
+				flit.Body.List = schemaReturnStmt()
+			}
+		}
+		return true
+	})
+
+	if !strip["timeouts"] {
+		return
+	}
+	ast.Inspect(fdecl.Body, func(n ast.Node) bool {
+		clit, ok := n.(*ast.CompositeLit)
+		if !ok {
+			return true
+		}
+		var kept []ast.Expr
+		for _, elt := range clit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if ok {
+				if keyIdent, ok := kv.Key.(*ast.Ident); ok && keyIdent.Name == "Timeouts" {
 					continue
 				}
-				modified = true
-				fdecl.Body.List = []ast.Stmt{
-					&ast.ReturnStmt{Results: []ast.Expr{&ast.Ident{Name: "nil"}}},
-				}
 			}
-			if modified {
-				if err := write(file, pkg.Fset); err != nil {
-					return err
+			kept = append(kept, elt)
+		}
+		clit.Elts = kept
+		return true
+	})
+}
+
+// scanUntypedFactoryImports mirrors applyUntypedFactoryStrip's decisions,
+// but walks the ORIGINAL (type-checked) factory body to record the
+// package-name uses that survive stripping, skipping exactly the
+// subexpressions applyUntypedFactoryStrip removes from the clone (the
+// Schema composite literal's elements, the SchemaFunc literal's body, the
+// Timeouts field) so the slim file neither misses an import a kept field
+// like Importer still needs nor carries one that was only used by the part
+// that got stripped away.
+func scanUntypedFactoryImports(pkg *packages.Package, fdecl *ast.FuncDecl, strip stripSet, seen map[string]*types.PkgName) {
+	ast.Inspect(fdecl.Body, func(n ast.Node) bool {
+		if kvexpr, ok := n.(*ast.KeyValueExpr); ok {
+			if keyIdent, ok := kvexpr.Key.(*ast.Ident); ok {
+				switch keyIdent.Name {
+				case "Schema":
+					if strip["schema"] {
+						if clit, ok := kvexpr.Value.(*ast.CompositeLit); ok {
+							scanPkgNameUses(pkg, clit.Type, seen)
+							return false
+						}
+					}
+				case "SchemaFunc":
+					if strip["schema"] {
+						if flit, ok := kvexpr.Value.(*ast.FuncLit); ok {
+							scanPkgNameUses(pkg, flit.Type, seen)
+							return false
+						}
+					}
+				case "Timeouts":
+					if strip["timeouts"] {
+						return false
+					}
 				}
 			}
 		}
+		if ident, ok := n.(*ast.Ident); ok {
+			if pn, ok := pkg.TypesInfo.Uses[ident].(*types.PkgName); ok {
+				seen[pn.Imported().Path()] = pn
+			}
+		}
+		return true
+	})
+}
+
+// schemaReturnStmt builds the body of a stripped Schema/SchemaFunc:
+// `return map[string]*pluginsdk.Schema{}`.
+func schemaReturnStmt() []ast.Stmt {
+	return []ast.Stmt{
+		&ast.ReturnStmt{Results: []ast.Expr{
+			&ast.CompositeLit{
+				Type: &ast.MapType{
+					Key: &ast.Ident{Name: "string"},
+					Value: &ast.StarExpr{X: &ast.SelectorExpr{
+						X:   &ast.Ident{Name: "pluginsdk"},
+						Sel: &ast.Ident{Name: "Schema"},
+					}},
+				},
+			},
+		}},
 	}
+}
 
-	return nil
+// nilReturnStmt builds the body of a stripped function: `return nil`.
+func nilReturnStmt() []ast.Stmt {
+	return []ast.Stmt{
+		&ast.ReturnStmt{Results: []ast.Expr{&ast.Ident{Name: "nil"}}},
+	}
+}
+
+// resourceFuncMethods are the sdk.Resource/sdk.ResourceWithUpdate methods
+// that return an sdk.ResourceFunc, whose inline Func closure gets nil'd out.
+var resourceFuncMethods = map[string]string{
+	"Create":        "create",
+	"Update":        "update",
+	"Delete":        "delete",
+	"Read":          "read",
+	"CustomizeDiff": "customizediff",
 }
 
-func forTyped(sdkPkg *packages.Package, servicePkgs []*packages.Package) error {
+// schemaMapMethods are the sdk.Resource methods that return
+// map[string]*pluginsdk.Schema, whose body gets replaced wholesale.
+var schemaMapMethods = map[string]string{
+	"Arguments":  "schema",
+	"Attributes": "attributes",
+}
+
+// forTyped locates the sdk.Resource/sdk.ResourceWithUpdate methods selected
+// by strip and registers a stubbed clone of each with collector, leaving the
+// original method declarations untouched.
+func forTyped(sdkPkg *packages.Package, servicePkgs []*packages.Package, strip stripSet, collector *stubCollector) error {
 	var crudFuncType types.Type
 	for ident, obj := range sdkPkg.TypesInfo.Defs {
 		if ident.Name == "ResourceRunFunc" {
@@ -156,85 +507,1008 @@ func forTyped(sdkPkg *packages.Package, servicePkgs []*packages.Package) error {
 		}
 	}
 
+	g := &errgroup.Group{}
+	g.SetLimit(parallelism())
 	for _, pkg := range servicePkgs {
-		for _, file := range pkg.Syntax {
-			var modified bool
-			for _, decl := range file.Decls {
-				fdecl, ok := decl.(*ast.FuncDecl)
-				if !ok {
-					continue
+		pkg := pkg
+		g.Go(func() error {
+			for _, file := range pkg.Syntax {
+				for _, decl := range file.Decls {
+					fdecl, ok := decl.(*ast.FuncDecl)
+					if !ok || fdecl.Name == nil || fdecl.Recv == nil {
+						continue
+					}
+					name := fdecl.Name.Name
+
+					if stripName, ok := resourceFuncMethods[name]; ok && strip[stripName] && matchesSelector(fdecl, "sdk", "ResourceFunc") {
+						var needsStub bool
+						ast.Inspect(fdecl.Body, func(n ast.Node) bool {
+							kvexpr, ok := n.(*ast.KeyValueExpr)
+							if !ok {
+								return true
+							}
+							keyIdent, ok := kvexpr.Key.(*ast.Ident)
+							if !ok || keyIdent.Name != "Func" {
+								return true
+							}
+							if !types.Identical(pkg.TypesInfo.TypeOf(kvexpr.Value), crudFuncType) {
+								return true
+							}
+							needsStub = true
+							return false
+						})
+						if needsStub {
+							clone, err := collector.clone(pkg, file, fdecl, func(p *packages.Package, seen map[string]*types.PkgName) {
+								scanResourceFuncImports(p, fdecl, seen)
+							})
+							if err != nil {
+								return err
+							}
+							nilOutFuncField(clone)
+						}
+					}
+
+					if stripName, ok := schemaMapMethods[name]; ok && strip[stripName] {
+						clone, err := collector.clone(pkg, file, fdecl, nil)
+						if err != nil {
+							return err
+						}
+						clone.Body.List = schemaReturnStmt()
+					}
+
+					if name == "IDValidationFunc" && strip["schema"] {
+						clone, err := collector.clone(pkg, file, fdecl, nil)
+						if err != nil {
+							return err
+						}
+						clone.Body.List = nilReturnStmt()
+					}
 				}
-				if fdecl.Name == nil {
-					continue
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// nilOutFuncField replaces the value of every `Func:` key-value pair found in
+// fdecl's body with a bare nil (without descending into a replaced value).
+func nilOutFuncField(fdecl *ast.FuncDecl) {
+	ast.Inspect(fdecl.Body, func(n ast.Node) bool {
+		kvexpr, ok := n.(*ast.KeyValueExpr)
+		if !ok {
+			return true
+		}
+		keyIdent, ok := kvexpr.Key.(*ast.Ident)
+		if !ok || keyIdent.Name != "Func" {
+			return true
+		}
+		kvexpr.Value = &ast.Ident{Name: "nil"}
+		return false
+	})
+}
+
+// scanResourceFuncImports mirrors nilOutFuncField's decision, walking the
+// ORIGINAL (type-checked) method body to record the package-name uses that
+// survive - everything except the Func: closure, which nilOutFuncField nils
+// out of the clone and so never reaches the slim file. Without this, a
+// field left untouched by nilOutFuncField (e.g. Timeout: 30 * time.Minute)
+// would need an import the generic Type/Recv scan never looks for.
+func scanResourceFuncImports(pkg *packages.Package, fdecl *ast.FuncDecl, seen map[string]*types.PkgName) {
+	ast.Inspect(fdecl.Body, func(n ast.Node) bool {
+		if kvexpr, ok := n.(*ast.KeyValueExpr); ok {
+			if keyIdent, ok := kvexpr.Key.(*ast.Ident); ok && keyIdent.Name == "Func" {
+				return false
+			}
+		}
+		if ident, ok := n.(*ast.Ident); ok {
+			if pn, ok := pkg.TypesInfo.Uses[ident].(*types.PkgName); ok {
+				seen[pn.Imported().Path()] = pn
+			}
+		}
+		return true
+	})
+}
+
+// matchesSelector reports whether fdecl's single return type is the selector
+// expression pkgName.typeName (e.g. sdk.ResourceFunc).
+func matchesSelector(fdecl *ast.FuncDecl, pkgName, typeName string) bool {
+	if fdecl.Type == nil || fdecl.Type.Results == nil || len(fdecl.Type.Results.List) != 1 {
+		return false
+	}
+	sel, ok := fdecl.Type.Results.List[0].Type.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	return x.Name == pkgName && sel.Sel.Name == typeName
+}
+
+// prune removes, per service package, imports and top-level declarations
+// that are unreachable from the package's Registration entrypoints: it is
+// destructive, but only against the pristine originals in pkg.Syntax, never
+// the generated *_slim.go companions. pruneUnusedImports drops import specs
+// syntactically unused within a file, and removeDeadDecls walks outward
+// from the package's surviving Registration/Resource/DataSource
+// entrypoints, deleting any top-level func/var/type that reachability
+// doesn't reach.
+//
+// Note this is no longer "once the CUD/read/schema bodies have been blanked
+// out": since writeDualMode stubs via clones rather than mutating pkg.Syntax
+// in place, stripping by itself never orphans a declaration in the original
+// file - the original still needs everything it always did, to stay
+// correct under the `!slim` tag. So in practice prune only catches helpers
+// that were already unreachable independent of -strip, and it never
+// shrinks the generated slim side, which is what the "smaller binary"
+// rationale behind -prune was actually after. It's kept as a generically
+// useful dead-code sweep, not as a -strip feature.
+//
+// prune runs after writeDualMode, so a file it touches may already carry the
+// `!slim` tag writeDualMode gave it; rewriting it must preserve that tag, or
+// the file stops being excluded from `-tags slim` builds and duplicates
+// symbols with its _slim.go companion.
+func prune(sdkPkg *packages.Package, servicePkgs []*packages.Package, collector *stubCollector) error {
+	for _, pkg := range servicePkgs {
+		reached := reachableObjects(sdkPkg, pkg)
+		changedFiles := removeDeadDecls(pkg, reached)
+
+		for _, file := range pkg.Syntax {
+			if pruneUnusedImports(pkg, file) {
+				changedFiles[file] = true
+			}
+		}
+
+		for file := range changedFiles {
+			if err := write(filePath(file, pkg.Fset), file, pkg.Fset, tagForFile(collector, file)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tagForFile reports the build tag writeDualMode assigned file: buildTagFull
+// if it has at least one stub (and thus a _slim.go companion), buildTagNone
+// otherwise.
+func tagForFile(collector *stubCollector, file *ast.File) buildTag {
+	if fs, ok := collector.byFile[file]; ok && len(fs.stubs) > 0 {
+		return buildTagFull
+	}
+	return buildTagNone
+}
+
+// reachableObjects computes the set of package-level objects in pkg that are
+// transitively referenced starting from its Registration type (and the
+// methods on it) plus whatever those methods in turn call into.
+func reachableObjects(sdkPkg *packages.Package, pkg *packages.Package) map[types.Object]bool {
+	typedIface, untypedIface := lookupRegistrationInterfaces(sdkPkg)
+	scope := pkg.Types.Scope()
+
+	roots := map[types.Object]bool{}
+	for _, name := range scope.Names() {
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok {
+			continue
+		}
+		named, ok := tn.Type().(*types.Named)
+		if !ok {
+			continue
+		}
+		isReg := typedIface != nil && (types.Implements(named, typedIface) || types.Implements(types.NewPointer(named), typedIface))
+		isReg = isReg || (untypedIface != nil && (types.Implements(named, untypedIface) || types.Implements(types.NewPointer(named), untypedIface)))
+		if !isReg {
+			continue
+		}
+		roots[tn] = true
+		mset := types.NewMethodSet(types.NewPointer(named))
+		for i := 0; i < mset.Len(); i++ {
+			roots[mset.At(i).Obj()] = true
+		}
+	}
+
+	reached := map[types.Object]bool{}
+	var visit func(types.Object)
+	visit = func(obj types.Object) {
+		if obj == nil || reached[obj] {
+			return
+		}
+		reached[obj] = true
+		if tn, ok := obj.(*types.TypeName); ok {
+			if named, ok := tn.Type().(*types.Named); ok {
+				for i := 0; i < named.NumMethods(); i++ {
+					visit(named.Method(i))
 				}
-				if name := fdecl.Name.Name; name != "Create" && name != "Update" && name != "Delete" {
-					continue
+			}
+		}
+		node := findDeclNode(pkg, obj)
+		if node == nil {
+			return
+		}
+		ast.Inspect(node, func(n ast.Node) bool {
+			ident, ok := n.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			used := pkg.TypesInfo.Uses[ident]
+			if used != nil && used.Parent() == scope {
+				visit(used)
+			}
+			return true
+		})
+	}
+	for obj := range roots {
+		visit(obj)
+	}
+	return reached
+}
+
+// findDeclNode locates the ast.Node (FuncDecl body, ValueSpec, or TypeSpec)
+// where a package-level object is declared, so its references can be walked.
+// Methods are included: reachableObjects seeds roots with a Registration
+// type's method set, and those bodies are exactly where the concrete
+// resource factories get referenced.
+func findDeclNode(pkg *packages.Package, obj types.Object) ast.Node {
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if pkg.TypesInfo.Defs[d.Name] == obj {
+					return d
 				}
-				if fdecl.Type == nil || fdecl.Type.Results == nil {
-					continue
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.ValueSpec:
+						for _, n := range s.Names {
+							if pkg.TypesInfo.Defs[n] == obj {
+								return s
+							}
+						}
+					case *ast.TypeSpec:
+						if pkg.TypesInfo.Defs[s.Name] == obj {
+							return s
+						}
+					}
 				}
-				if len(fdecl.Type.Results.List) != 1 {
-					continue
+			}
+		}
+	}
+	return nil
+}
+
+// declObjects returns the package-level objects a top-level decl defines.
+func declObjects(pkg *packages.Package, decl ast.Decl) []types.Object {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Recv != nil {
+			return nil
+		}
+		return []types.Object{pkg.TypesInfo.Defs[d.Name]}
+	case *ast.GenDecl:
+		var objs []types.Object
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.ValueSpec:
+				for _, n := range s.Names {
+					objs = append(objs, pkg.TypesInfo.Defs[n])
 				}
-				ret := fdecl.Type.Results.List[0]
-				sel, ok := ret.Type.(*ast.SelectorExpr)
-				if !ok {
-					continue
+			case *ast.TypeSpec:
+				objs = append(objs, pkg.TypesInfo.Defs[s.Name])
+			}
+		}
+		return objs
+	}
+	return nil
+}
+
+// removeDeadDecls deletes top-level func/var/const/type declarations whose
+// objects are absent from reached, and reports which files were modified.
+func removeDeadDecls(pkg *packages.Package, reached map[types.Object]bool) map[*ast.File]bool {
+	changed := map[*ast.File]bool{}
+	for _, file := range pkg.Syntax {
+		var kept []ast.Decl
+		for _, decl := range file.Decls {
+			if gdecl, ok := decl.(*ast.GenDecl); ok && gdecl.Tok == token.IMPORT {
+				kept = append(kept, decl)
+				continue
+			}
+			objs := declObjects(pkg, decl)
+			if len(objs) == 0 {
+				kept = append(kept, decl)
+				continue
+			}
+
+			if gdecl, ok := decl.(*ast.GenDecl); ok {
+				var keptSpecs []ast.Spec
+				for _, spec := range gdecl.Specs {
+					var specObjs []types.Object
+					switch s := spec.(type) {
+					case *ast.ValueSpec:
+						for _, n := range s.Names {
+							specObjs = append(specObjs, pkg.TypesInfo.Defs[n])
+						}
+					case *ast.TypeSpec:
+						specObjs = append(specObjs, pkg.TypesInfo.Defs[s.Name])
+					}
+					if anyReached(specObjs, reached) {
+						keptSpecs = append(keptSpecs, spec)
+					} else {
+						changed[file] = true
+					}
 				}
-				x, ok := sel.X.(*ast.Ident)
-				if !ok {
+				if len(keptSpecs) == 0 {
 					continue
 				}
-				if x.Name != "sdk" {
-					continue
+				gdecl.Specs = keptSpecs
+				kept = append(kept, gdecl)
+				continue
+			}
+
+			if anyReached(objs, reached) {
+				kept = append(kept, decl)
+			} else {
+				changed[file] = true
+			}
+		}
+		file.Decls = kept
+	}
+	return changed
+}
+
+func anyReached(objs []types.Object, reached map[types.Object]bool) bool {
+	for _, o := range objs {
+		if reached[o] {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneUnusedImports drops import specs from file that are no longer
+// referenced anywhere in the file, leaving dot and blank imports untouched.
+func pruneUnusedImports(pkg *packages.Package, file *ast.File) bool {
+	usedPaths := map[string]bool{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		if pn, ok := pkg.TypesInfo.Uses[ident].(*types.PkgName); ok {
+			usedPaths[pn.Imported().Path()] = true
+		}
+		return true
+	})
+
+	var changed bool
+	var keptDecls []ast.Decl
+	for _, decl := range file.Decls {
+		gdecl, ok := decl.(*ast.GenDecl)
+		if !ok || gdecl.Tok != token.IMPORT {
+			keptDecls = append(keptDecls, decl)
+			continue
+		}
+		var keptSpecs []ast.Spec
+		for _, spec := range gdecl.Specs {
+			ispec := spec.(*ast.ImportSpec)
+			if ispec.Name != nil && (ispec.Name.Name == "_" || ispec.Name.Name == ".") {
+				keptSpecs = append(keptSpecs, spec)
+				continue
+			}
+			path := strings.Trim(ispec.Path.Value, `"`)
+			if usedPaths[path] {
+				keptSpecs = append(keptSpecs, spec)
+				continue
+			}
+			changed = true
+		}
+		if len(keptSpecs) == 0 {
+			continue
+		}
+		gdecl.Specs = keptSpecs
+		keptDecls = append(keptDecls, gdecl)
+	}
+	file.Decls = keptDecls
+	return changed
+}
+
+// buildManifest walks every service package and, for the concrete
+// Registration type that implements sdk.TypedServiceRegistration and/or
+// sdk.UntypedServiceRegistration, inspects the bodies of its
+// SupportedResources/Resources and SupportedDataSources/DataSources methods
+// to recover the mapping from Terraform type name to the Go factory that
+// backs it.
+func buildManifest(sdkPkg *packages.Package, servicePkgs []*packages.Package) ([]resourceMapping, error) {
+	typedIface, untypedIface := lookupRegistrationInterfaces(sdkPkg)
+	if typedIface == nil && untypedIface == nil {
+		return nil, errors.New("could not find TypedServiceRegistration/UntypedServiceRegistration in internal/sdk")
+	}
+
+	var out []resourceMapping
+	for _, pkg := range servicePkgs {
+		scope := pkg.Types.Scope()
+		for _, name := range scope.Names() {
+			obj, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			named, ok := obj.Type().(*types.Named)
+			if !ok {
+				continue
+			}
+			isTyped := typedIface != nil && (types.Implements(named, typedIface) || types.Implements(types.NewPointer(named), typedIface))
+			isUntyped := untypedIface != nil && (types.Implements(named, untypedIface) || types.Implements(types.NewPointer(named), untypedIface))
+			if !isTyped && !isUntyped {
+				continue
+			}
+
+			if isUntyped {
+				entries, err := collectUntypedEntries(pkg, named, "SupportedResources", "resource")
+				if err != nil {
+					return nil, err
 				}
-				if sel.Sel.Name != "ResourceFunc" {
-					continue
+				out = append(out, entries...)
+				entries, err = collectUntypedEntries(pkg, named, "SupportedDataSources", "data_source")
+				if err != nil {
+					return nil, err
 				}
-				ast.Inspect(fdecl.Body, func(n ast.Node) bool {
-					kvexpr, ok := n.(*ast.KeyValueExpr)
-					if !ok {
-						return true
-					}
-					keyIdent, ok := kvexpr.Key.(*ast.Ident)
-					if !ok {
-						return true
-					}
-					if keyIdent.Name != "Func" {
-						return true
-					}
-					if !types.Identical(pkg.TypesInfo.TypeOf(kvexpr.Value), crudFuncType) {
-						return true
-					}
-					modified = true
-					kvexpr.Value = &ast.Ident{Name: "nil"}
-					return false
-				})
+				out = append(out, entries...)
 			}
-			if modified {
-				if err := write(file, pkg.Fset); err != nil {
-					return err
+
+			if isTyped {
+				entries, err := collectTypedEntries(pkg, named, "Resources", "resource")
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, entries...)
+				entries, err = collectTypedEntries(pkg, named, "DataSources", "data_source")
+				if err != nil {
+					return nil, err
 				}
+				out = append(out, entries...)
+			}
+		}
+	}
+	return out, nil
+}
+
+// lookupRegistrationInterfaces returns the *types.Interface underlying
+// sdk.TypedServiceRegistration and sdk.UntypedServiceRegistration, if found.
+func lookupRegistrationInterfaces(sdkPkg *packages.Package) (typed, untyped *types.Interface) {
+	for ident, obj := range sdkPkg.TypesInfo.Defs {
+		tn, ok := obj.(*types.TypeName)
+		if !ok {
+			continue
+		}
+		iface, ok := tn.Type().Underlying().(*types.Interface)
+		if !ok {
+			continue
+		}
+		switch ident.Name {
+		case "TypedServiceRegistration":
+			typed = iface
+		case "UntypedServiceRegistration":
+			untyped = iface
+		}
+	}
+	return typed, untyped
+}
+
+// collectUntypedEntries inspects the body of the named method on recv (e.g.
+// SupportedResources) and collects one resourceMapping per key/value pair of
+// the returned map[string]*pluginsdk.Resource literal.
+func collectUntypedEntries(pkg *packages.Package, recv *types.Named, method, kind string) ([]resourceMapping, error) {
+	fdecl := findMethodDecl(pkg, recv, method)
+	if fdecl == nil || fdecl.Body == nil {
+		return nil, nil
+	}
+
+	var out []resourceMapping
+	ast.Inspect(fdecl.Body, func(n ast.Node) bool {
+		clit, ok := n.(*ast.CompositeLit)
+		if !ok {
+			return true
+		}
+		if _, ok := clit.Type.(*ast.MapType); !ok {
+			return true
+		}
+		for _, elt := range clit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			key, ok := kv.Key.(*ast.BasicLit)
+			if !ok {
+				continue
+			}
+			pos := pkg.Fset.Position(kv.Value.Pos())
+			out = append(out, resourceMapping{
+				Package: pkg.PkgPath,
+				Name:    strings.Trim(key.Value, `"`),
+				Kind:    kind,
+				GoType:  types.ExprString(kv.Value),
+				File:    pos.Filename,
+				Line:    pos.Line,
+			})
+		}
+		return false
+	})
+	return out, nil
+}
+
+// collectTypedEntries inspects the body of the named method on recv (e.g.
+// Resources) and collects one resourceMapping per element of the returned
+// []sdk.Resource/[]sdk.DataSource slice literal, naming each entry by its
+// ResourceType() return value, or by its Go expression when resourceTypeName
+// cannot resolve one.
+func collectTypedEntries(pkg *packages.Package, recv *types.Named, method, kind string) ([]resourceMapping, error) {
+	fdecl := findMethodDecl(pkg, recv, method)
+	if fdecl == nil || fdecl.Body == nil {
+		return nil, nil
+	}
+
+	var out []resourceMapping
+	ast.Inspect(fdecl.Body, func(n ast.Node) bool {
+		clit, ok := n.(*ast.CompositeLit)
+		if !ok {
+			return true
+		}
+		if _, ok := clit.Type.(*ast.ArrayType); !ok {
+			return true
+		}
+		for _, elt := range clit.Elts {
+			pos := pkg.Fset.Position(elt.Pos())
+			name, ok := resourceTypeName(pkg, elt)
+			if !ok {
+				name = types.ExprString(elt)
+			}
+			out = append(out, resourceMapping{
+				Package: pkg.PkgPath,
+				Name:    name,
+				Kind:    kind,
+				GoType:  types.ExprString(elt),
+				File:    pos.Filename,
+				Line:    pos.Line,
+			})
+		}
+		return false
+	})
+	return out, nil
+}
+
+// resourceTypeName resolves elt's type and, if it declares a ResourceType()
+// method whose body is a single `return "<literal>"`, returns that literal -
+// the registered Terraform resource/data source type name. Reports false if
+// elt's type has no such method or its body isn't a plain string return.
+func resourceTypeName(pkg *packages.Package, elt ast.Expr) (string, bool) {
+	t := pkg.TypesInfo.TypeOf(elt)
+	if t == nil {
+		return "", false
+	}
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok {
+		return "", false
+	}
+
+	fdecl := findMethodDecl(pkg, named, "ResourceType")
+	if fdecl == nil || fdecl.Body == nil {
+		return "", false
+	}
+
+	var name string
+	ast.Inspect(fdecl.Body, func(n ast.Node) bool {
+		ret, ok := n.(*ast.ReturnStmt)
+		if !ok || len(ret.Results) != 1 {
+			return true
+		}
+		lit, ok := ret.Results[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		name = strings.Trim(lit.Value, `"`)
+		return false
+	})
+	return name, name != ""
+}
+
+// findMethodDecl locates the *ast.FuncDecl for the named method declared
+// with receiver recv within pkg's syntax trees.
+func findMethodDecl(pkg *packages.Package, recv *types.Named, method string) *ast.FuncDecl {
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			fdecl, ok := decl.(*ast.FuncDecl)
+			if !ok || fdecl.Recv == nil || fdecl.Name.Name != method {
+				continue
+			}
+			obj := pkg.TypesInfo.Defs[fdecl.Name]
+			fn, ok := obj.(*types.Func)
+			if !ok {
+				continue
+			}
+			sig := fn.Type().(*types.Signature)
+			rt := sig.Recv().Type()
+			if p, ok := rt.(*types.Pointer); ok {
+				rt = p.Elem()
+			}
+			if named, ok := rt.(*types.Named); ok && named.Obj() == recv.Obj() {
+				return fdecl
 			}
 		}
 	}
 	return nil
 }
 
-func write(file *ast.File, fset *token.FileSet) error {
-	pos := fset.Position(file.Pos())
-	f, err := os.OpenFile(pos.Filename, os.O_WRONLY|os.O_TRUNC, 0644)
+func writeManifest(path string, mapping []resourceMapping) error {
+	f, err := os.Create(path)
 	if err != nil {
-		return fmt.Errorf("openning %s for rewriting", pos.Filename)
+		return fmt.Errorf("creating manifest file %s: %w", path, err)
 	}
 	defer f.Close()
-	if err := format.Node(f, fset, file); err != nil {
-		return fmt.Errorf("rewriting %s", pos.Filename)
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(mapping); err != nil {
+		return fmt.Errorf("encoding manifest: %w", err)
 	}
 	return nil
 }
 
+// buildTag is a `//go:build` constraint prefixed to a file written by write.
+type buildTag string
+
+const (
+	buildTagNone buildTag = ""
+	buildTagFull buildTag = "!slim"
+	buildTagSlim buildTag = "slim"
+)
+
+// filePath returns the filesystem path file was loaded from.
+func filePath(file *ast.File, fset *token.FileSet) string {
+	return fset.Position(file.Pos()).Filename
+}
+
+func write(path string, file *ast.File, fset *token.FileSet, tag buildTag) error {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		return fmt.Errorf("rewriting %s", path)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("openning %s for rewriting", path)
+	}
+	defer f.Close()
+	if tag != buildTagNone {
+		if _, err := fmt.Fprintf(f, "//go:build %s\n// +build %s\n\n", tag, tag); err != nil {
+			return fmt.Errorf("writing build tag to %s", path)
+		}
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("writing %s", path)
+	}
+	return nil
+}
+
+// stubFunc pairs a cloned, stubbed-out function declaration with the
+// original it was cloned from (kept only for import bookkeeping).
+type stubFunc struct {
+	clone *ast.FuncDecl
+	orig  *ast.FuncDecl
+	// extraImports scans whatever of orig's body survives in clone for
+	// package-name uses, when stubbing only mutated part of the body in
+	// place (nilOutFuncField, applyUntypedFactoryStrip) rather than
+	// replacing it wholesale. nil when the clone's body is fully synthetic
+	// and so carries none of orig's import requirements.
+	extraImports func(pkg *packages.Package, seen map[string]*types.PkgName)
+}
+
+// fileStubs accumulates the stub clones destined for one origin file's
+// companion _slim.go, plus enough context to write both files back out.
+type fileStubs struct {
+	pkg       *packages.Package
+	cloneFset *token.FileSet
+	path      string
+	stubs     []stubFunc
+	// recvTypes holds the object for every receiver type a stub method
+	// hangs off of; its TypeSpec (and anything it embeds) must also be
+	// emitted into the slim file, since the file that declares it stays
+	// behind the !slim tag.
+	recvTypes map[types.Object]bool
+}
+
+// stubCollector gathers, across forUntyped and forTyped, the clones that
+// will become each modified file's companion *_slim.go counterpart. Since
+// forUntyped and forTyped rewrite service packages concurrently, clone is
+// safe for concurrent use: mu guards byFile and each fileStubs entry's
+// stubs slice and recvTypes set.
+type stubCollector struct {
+	mu     sync.Mutex
+	byFile map[*ast.File]*fileStubs
+}
+
+func newStubCollector() *stubCollector {
+	return &stubCollector{byFile: map[*ast.File]*fileStubs{}}
+}
+
+// clone produces an independent copy of fdecl (reparsed from its formatted
+// source, so mutating it never touches the original file's AST) and
+// registers it against file's fileStubs entry. Safe to call concurrently.
+//
+// extraImports should be nil when the caller is about to replace the
+// clone's body wholesale (the stub needs nothing from orig beyond its
+// signature/receiver), or a scanner when the caller only mutates part of
+// the body in place and the surviving part may still reference packages
+// importsForStubs needs to know about.
+func (c *stubCollector) clone(pkg *packages.Package, file *ast.File, fdecl *ast.FuncDecl, extraImports func(pkg *packages.Package, seen map[string]*types.PkgName)) (*ast.FuncDecl, error) {
+	c.mu.Lock()
+	fs, ok := c.byFile[file]
+	if !ok {
+		fs = &fileStubs{pkg: pkg, cloneFset: token.NewFileSet(), path: filePath(file, pkg.Fset)}
+		c.byFile[file] = fs
+	}
+	c.mu.Unlock()
+
+	// cloneFuncDecl only reads from pkg.Fset/fdecl and adds a file to the
+	// per-origin-file fs.cloneFset (a token.FileSet, safe for concurrent
+	// use), so the actual clone work can happen outside the lock; only
+	// updating fs.stubs and fs.recvTypes needs it.
+	clone, err := cloneFuncDecl(fs.cloneFset, pkg.Fset, fdecl)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	fs.stubs = append(fs.stubs, stubFunc{clone: clone, orig: fdecl, extraImports: extraImports})
+	if recv := receiverNamedObj(pkg, fdecl); recv != nil {
+		if fs.recvTypes == nil {
+			fs.recvTypes = map[types.Object]bool{}
+		}
+		fs.recvTypes[recv] = true
+	}
+	c.mu.Unlock()
+	return clone, nil
+}
+
+// receiverNamedObj resolves fdecl's receiver (T or *T) to the types.Object
+// it names, using the original, type-checked declaration.
+func receiverNamedObj(pkg *packages.Package, fdecl *ast.FuncDecl) types.Object {
+	if fdecl.Recv == nil || len(fdecl.Recv.List) == 0 {
+		return nil
+	}
+	expr := fdecl.Recv.List[0].Type
+	if s, ok := expr.(*ast.StarExpr); ok {
+		expr = s.X
+	}
+	ident, ok := expr.(*ast.Ident)
+	if !ok {
+		return nil
+	}
+	return pkg.TypesInfo.Uses[ident]
+}
+
+// cloneFuncDecl renders fdecl to source with origFset and reparses it into a
+// standalone *ast.FuncDecl registered against dstFset, independent of the
+// original's AST.
+func cloneFuncDecl(dstFset *token.FileSet, origFset *token.FileSet, fdecl *ast.FuncDecl) (*ast.FuncDecl, error) {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, origFset, fdecl); err != nil {
+		return nil, fmt.Errorf("cloning %s: %w", fdecl.Name.Name, err)
+	}
+	src := "package p\n\n" + buf.String() + "\n"
+	f, err := parser.ParseFile(dstFset, "", src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reparsing clone of %s: %w", fdecl.Name.Name, err)
+	}
+	return f.Decls[0].(*ast.FuncDecl), nil
+}
+
+// writeDualMode emits, for every origin file with at least one stub, the
+// original file tagged `//go:build !slim` (content otherwise untouched) and
+// a sibling `<name>_slim.go` tagged `//go:build slim` holding the stub
+// clones, the TypeSpecs of the types they're methods on (plus anything those
+// embed), and whatever imports all of that requires.
+func writeDualMode(c *stubCollector) error {
+	for file, fs := range c.byFile {
+		if len(fs.stubs) == 0 {
+			continue
+		}
+
+		if err := write(fs.path, file, fs.pkg.Fset, buildTagFull); err != nil {
+			return err
+		}
+
+		recvSpecs := neededTypeSpecs(fs.pkg, fs.recvTypes)
+		typeDecls := make([]*ast.GenDecl, 0, len(recvSpecs))
+		for _, ts := range recvSpecs {
+			clone, err := cloneTypeSpec(fs.cloneFset, fs.pkg.Fset, ts)
+			if err != nil {
+				return err
+			}
+			typeDecls = append(typeDecls, clone)
+		}
+
+		var decls []ast.Decl
+		if imports := importsForStubs(fs.pkg, fs.stubs, recvSpecs); len(imports) > 0 {
+			decls = append(decls, &ast.GenDecl{Tok: token.IMPORT, Specs: imports})
+		}
+		for _, td := range typeDecls {
+			decls = append(decls, td)
+		}
+		for _, s := range fs.stubs {
+			decls = append(decls, s.clone)
+		}
+		slimFile := &ast.File{Name: ast.NewIdent(file.Name.Name), Decls: decls}
+
+		slimPath := strings.TrimSuffix(fs.path, ".go") + "_slim.go"
+		if err := write(slimPath, slimFile, fs.cloneFset, buildTagSlim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// neededTypeSpecs resolves seed (typically a stub method set's receiver
+// types) to their original *ast.TypeSpec declarations, then transitively
+// follows embedded fields naming other local types, so a struct's embeds are
+// never left undeclared in the slim file. Order is deterministic: the seed
+// types sorted by name, followed by the types they embed, breadth-first.
+func neededTypeSpecs(pkg *packages.Package, seed map[types.Object]bool) []*ast.TypeSpec {
+	if len(seed) == 0 {
+		return nil
+	}
+
+	queue := make([]types.Object, 0, len(seed))
+	for obj := range seed {
+		queue = append(queue, obj)
+	}
+	sort.Slice(queue, func(i, j int) bool { return queue[i].Name() < queue[j].Name() })
+
+	seen := map[types.Object]bool{}
+	var out []*ast.TypeSpec
+	for len(queue) > 0 {
+		obj := queue[0]
+		queue = queue[1:]
+		if obj == nil || seen[obj] {
+			continue
+		}
+		seen[obj] = true
+
+		ts := findTypeSpec(pkg, obj)
+		if ts == nil {
+			continue
+		}
+		out = append(out, ts)
+		queue = append(queue, embeddedTypeObjs(pkg, ts)...)
+	}
+	return out
+}
+
+// findTypeSpec locates the *ast.TypeSpec declaring obj within pkg's syntax.
+func findTypeSpec(pkg *packages.Package, obj types.Object) *ast.TypeSpec {
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			gdecl, ok := decl.(*ast.GenDecl)
+			if !ok || gdecl.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gdecl.Specs {
+				ts, ok := spec.(*ast.TypeSpec)
+				if ok && pkg.TypesInfo.Defs[ts.Name] == obj {
+					return ts
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// embeddedTypeObjs returns the objects named by ts's embedded (anonymous)
+// struct fields that resolve to a local identifier, i.e. another type in the
+// same package that also needs declaring in the slim file.
+func embeddedTypeObjs(pkg *packages.Package, ts *ast.TypeSpec) []types.Object {
+	st, ok := ts.Type.(*ast.StructType)
+	if !ok || st.Fields == nil {
+		return nil
+	}
+	var out []types.Object
+	for _, field := range st.Fields.List {
+		if len(field.Names) != 0 {
+			continue
+		}
+		expr := field.Type
+		if s, ok := expr.(*ast.StarExpr); ok {
+			expr = s.X
+		}
+		ident, ok := expr.(*ast.Ident)
+		if !ok {
+			continue
+		}
+		if obj := pkg.TypesInfo.Uses[ident]; obj != nil {
+			out = append(out, obj)
+		}
+	}
+	return out
+}
+
+// cloneTypeSpec clones ts (wrapped in its own `type` GenDecl, independent of
+// whatever other specs shared its original GenDecl) the same way
+// cloneFuncDecl clones a method: format then reparse into dstFset.
+func cloneTypeSpec(dstFset, origFset *token.FileSet, ts *ast.TypeSpec) (*ast.GenDecl, error) {
+	wrapper := &ast.GenDecl{Tok: token.TYPE, Specs: []ast.Spec{ts}}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, origFset, wrapper); err != nil {
+		return nil, fmt.Errorf("cloning type %s: %w", ts.Name.Name, err)
+	}
+	src := "package p\n\n" + buf.String() + "\n"
+	f, err := parser.ParseFile(dstFset, "", src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reparsing clone of type %s: %w", ts.Name.Name, err)
+	}
+	return f.Decls[0].(*ast.GenDecl), nil
+}
+
+// importsForStubs computes the minimal import set the stubs' signatures
+// (and receivers), whatever of their original bodies still survives in the
+// clone per extraImports, and the needed receiver TypeSpecs require, by
+// inspecting the ORIGINAL declarations' resolved *types.PkgName uses - the
+// clones themselves carry no type information.
+func importsForStubs(pkg *packages.Package, stubs []stubFunc, recvSpecs []*ast.TypeSpec) []ast.Spec {
+	seen := map[string]*types.PkgName{}
+	for _, s := range stubs {
+		scanPkgNameUses(pkg, s.orig.Type, seen)
+		if s.orig.Recv != nil {
+			scanPkgNameUses(pkg, s.orig.Recv, seen)
+		}
+		if s.extraImports != nil {
+			s.extraImports(pkg, seen)
+		}
+	}
+	for _, ts := range recvSpecs {
+		scanPkgNameUses(pkg, ts, seen)
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(seen))
+	for p := range seen {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	specs := make([]ast.Spec, 0, len(paths))
+	for _, p := range paths {
+		pn := seen[p]
+		spec := &ast.ImportSpec{Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(p)}}
+		if pn.Name() != pn.Imported().Name() {
+			spec.Name = ast.NewIdent(pn.Name())
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+func scanPkgNameUses(pkg *packages.Package, node ast.Node, seen map[string]*types.PkgName) {
+	if node == nil {
+		return
+	}
+	ast.Inspect(node, func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		if pn, ok := pkg.TypesInfo.Uses[ident].(*types.PkgName); ok {
+			seen[pn.Imported().Path()] = pn
+		}
+		return true
+	})
+}
+
 func main() {
+	flag.Parse()
 	if err := run(); err != nil {
 		log.Fatal(err)
 	}